@@ -0,0 +1,62 @@
+package main
+
+//group aggregates the measurements of every PID that shares a container,
+//systemd unit, cgroup or PID namespace, so memory can be attributed to the
+//whole of a container rather than its individual (and often short-lived)
+//processes
+type group struct {
+	Kind string   `json:"kind"`
+	ID   string   `json:"id"`
+	Pids []string `json:"pids"`
+	RSS  int      `json:"rss"`
+	PSS  int      `json:"pss"`
+	USS  int      `json:"uss"`
+	Swap int      `json:"swap"`
+}
+
+//groupKey picks the most specific identity available for a process: the
+//container it belongs to, else its systemd unit, else its raw cgroup path,
+//else its PID namespace, else the host itself
+func groupKey(pd *piddata) (kind, id string) {
+	switch {
+	case pd.ContainerID != "":
+		return "container", pd.ContainerID
+	case pd.Unit != "":
+		return "unit", pd.Unit
+	case pd.Cgroup != "":
+		return "cgroup", pd.Cgroup
+	case pd.PIDNS != "":
+		return "namespace", pd.PIDNS
+	default:
+		return "host", "host"
+	}
+}
+
+//buildGroups rolls up pids into groups keyed by groupKey. Callers must hold
+//mu for reading.
+func buildGroups(pids map[string]*piddata) []group {
+	byKey := make(map[string]*group)
+	var order []string
+
+	for pid, pd := range pids {
+		kind, id := groupKey(pd)
+		key := kind + ":" + id
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{Kind: kind, ID: id}
+			byKey[key] = g
+			order = append(order, key)
+		}
+		g.Pids = append(g.Pids, pid)
+		g.RSS += pd.RSS
+		g.PSS += pd.PSS
+		g.USS += pd.USS
+		g.Swap += pd.Swap
+	}
+
+	groups := make([]group, 0, len(order))
+	for _, key := range order {
+		groups = append(groups, *byKey[key])
+	}
+	return groups
+}
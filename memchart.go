@@ -1,28 +1,55 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//mapping represents a single entry of /proc/$PID/smaps
+type mapping struct {
+	Path         string `json:"path"`
+	Perms        string `json:"perms"`
+	Size         int    `json:"size"`
+	RSS          int    `json:"rss"`
+	PSS          int    `json:"pss"`
+	SharedClean  int    `json:"shared_clean"`
+	SharedDirty  int    `json:"shared_dirty"`
+	PrivateClean int    `json:"private_clean"`
+	PrivateDirty int    `json:"private_dirty"`
+	Swap         int    `json:"swap"`
+	SwapPSS      int    `json:"swap_pss"`
+	Anonymous    int    `json:"anonymous"`
+	Referenced   int    `json:"referenced"`
+	Locked       int    `json:"locked"`
+}
+
 //piddata represents Data read from /proc/$PID
 type piddata struct {
-	cmdline string
-	Name    string `json:"name"`
-	RSS     int    `json:"rss"`
-	PSS     int    `json:"pss"`
-	USS     int    `json:"uss"`
+	cmdline     string
+	Name        string    `json:"name"`
+	RSS         int       `json:"rss"`
+	PSS         int       `json:"pss"`
+	USS         int       `json:"uss"`
+	Swap        int       `json:"swap"`
+	Maps        []mapping `json:"maps"`
+	Cgroup      string    `json:"cgroup,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	ContainerID string    `json:"container_id,omitempty"`
+	PIDNS       string    `json:"pid_ns,omitempty"`
 }
 
 //isKernelProc checks whether the given piddata is of a kernel process
@@ -30,82 +57,102 @@ func isKernelProc(pd *piddata) bool {
 	return len(pd.cmdline) == 0
 }
 
-//snapshotPid reads raw data from the /proc files corresponding to pid
-func snapshotPid(pid string) (*piddata, error) {
-	pidpath := "/proc/" + pid + "/"
-	cmdline, err := ioutil.ReadFile(pidpath + "cmdline")
-	if err != nil {
-		log.Println("No process with pid", pid)
-		return nil, err
-	}
-	smaps, err := ioutil.ReadFile(pidpath + "smaps")
-	if err != nil {
-		return nil, err
-	}
-	stat, err := ioutil.ReadFile(pidpath + "stat")
-	if err != nil {
-		return nil, err
-	}
-	i, j := strings.Index(string(stat), "("), strings.Index(string(stat), ")")
-	name := string(stat[i+1 : j])
-
-	pd := &piddata{cmdline: string(cmdline), Name: name}
-	pd.RSS, pd.PSS, pd.USS = memsizes(string(smaps))
-
-	return pd, nil
-}
-
-//The representation of all mappings belonging to a PID keyed on start address
-type pmaps map[string]map[string]int
-
 var allpids map[string]*piddata
 
-// getsmaps extracts the individual map entries from a smaps-formatted string
-func getsmaps(smaps string) *pmaps {
-	pm := make(pmaps)
+//mu guards allpids and history against concurrent access by the sampling
+//loop and the HTTP handlers
+var mu sync.RWMutex
+
+//history is a bounded ring buffer of past snapshots, most recent last
+var history []snap
+var seqNum int
+
+//subsMu guards subscribers, the set of live /stream connections
+var subsMu sync.Mutex
+var subscribers = map[chan snap]struct{}{}
+
+//subscribe registers a new /stream connection and returns the channel it
+//should read published snapshots from
+func subscribe() chan snap {
+	ch := make(chan snap, 1)
+	subsMu.Lock()
+	subscribers[ch] = struct{}{}
+	subsMu.Unlock()
+	return ch
+}
 
-	lines := strings.Split(smaps, "\n")
-	start := ""
+//unsubscribe removes and closes a channel returned by subscribe
+func unsubscribe(ch chan snap) {
+	subsMu.Lock()
+	delete(subscribers, ch)
+	subsMu.Unlock()
+	close(ch)
+}
 
-	for _, line := range lines {
-		if len(line) == 0 {
-			break
-		}
-		f := strings.Fields(line)
-		if "kB" != (f[len(f)-1]) {
-			start = strings.Split(f[0], "-")[0]
-			pm[start] = make(map[string]int)
-		} else {
-			n := strings.ToLower(strings.TrimRight(f[0], ":"))
-			pm[start][n], _ = strconv.Atoi(f[1])
+//broadcast publishes a snapshot to every live subscriber, dropping it for
+//any subscriber that isn't keeping up rather than blocking the sampling loop
+func broadcast(s snap) {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- s:
+		default:
 		}
 	}
-
-	return &pm
 }
 
-func memsizes(smaps string) (int, int, int) {
-	pm := getsmaps(smaps)
-	rss, pss, uss := 0, 0, 0
-	for _, m := range *pm {
-		rss += m["rss"]
-		pss += m["pss"]
-		uss += m["private_clean"] + m["private_dirty"]
+//anonPSS returns the PSS attributable to anonymous (non-file-backed) mappings
+func anonPSS(maps []mapping) int {
+	pss := 0
+	for _, m := range maps {
+		if m.Path == "" {
+			pss += m.PSS
+		}
 	}
-	return rss, pss, uss
+	return pss
 }
 
-//A snapshot containing the timestamp and all PIDs' data
+//A snapshot containing the timestamp and all PIDs' data plus derived totals
 type snap struct {
-	Time string              `json:"time"`
-	Pids map[string]*piddata `json:"pids"`
+	Seq         int                 `json:"seq"`
+	Time        string              `json:"time"`
+	Pids        map[string]*piddata `json:"pids"`
+	TotalSwap   int                 `json:"total_swap"`
+	SharedClean int                 `json:"shared_clean"`
+	SharedDirty int                 `json:"shared_dirty"`
+	AnonPSS     int                 `json:"anon_pss"`
+	Groups      []group             `json:"groups"`
+}
+
+//makeSnap builds a snap from the current allpids, including the aggregate
+//fields. Pids is copied into a map of its own, so the snap remains an
+//honest point-in-time view even if allpids itself is later replaced or
+//(on some future code path) mutated in place. Callers must hold mu.
+func makeSnap() snap {
+	pids := make(map[string]*piddata, len(allpids))
+	for pid, pd := range allpids {
+		pids[pid] = pd
+	}
+
+	s := snap{Seq: seqNum, Time: time.Now().Format("03:04:05"), Pids: pids}
+	for _, pd := range pids {
+		s.TotalSwap += pd.Swap
+		s.AnonPSS += anonPSS(pd.Maps)
+		for _, m := range pd.Maps {
+			s.SharedClean += m.SharedClean
+			s.SharedDirty += m.SharedDirty
+		}
+	}
+	s.Groups = buildGroups(pids)
+	return s
 }
 
 //Creates a JSON string reflecting the current snapshot
-//FIXME: need syncronization between constructing and printing the map
 func makeJSON() string {
-	timestamp := time.Now().Format("03:04:05")
-	j, err := json.MarshalIndent(snap{timestamp, allpids}, "", "  ")
+	mu.RLock()
+	defer mu.RUnlock()
+	j, err := json.MarshalIndent(makeSnap(), "", "  ")
 	if err != nil {
 		panic(err)
 	}
@@ -114,6 +161,8 @@ func makeJSON() string {
 
 //Returns a tabular format of the measurements suitable for CSV output
 func makeCSV() [][]string {
+	mu.RLock()
+	defer mu.RUnlock()
 	d := make([][]string, len(allpids))
 	c := 0
 	for pid, entry := range allpids {
@@ -142,53 +191,99 @@ func dump(typ int) {
 	}
 }
 
+//lastSampleUnixNano and lastIntervalNano track when sampling last ran and
+//how long actually elapsed since the run before it, so /self can report
+//sampling lag against the configured -s interval
+var lastSampleUnixNano int64
+var lastIntervalNano int64
+
 func work(pids []string) {
 	if len(pids) == 0 {
-		pids = snapshotAll()
+		var err error
+		pids, err = source.List()
+		if err != nil {
+			log.Println("listing processes:", err)
+			return
+		}
+	}
+
+	now := time.Now().UnixNano()
+	if prev := atomic.SwapInt64(&lastSampleUnixNano, now); prev != 0 {
+		atomic.StoreInt64(&lastIntervalNano, now-prev)
+	}
+
+	newpids := snapshotPids(pids)
+
+	mu.Lock()
+	allpids = newpids
+	seqNum++
+	s := makeSnap()
+	history = append(history, s)
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
 	}
-	snapshotPids(pids)
+	mu.Unlock()
+
+	broadcast(s)
+
 	if verbose {
 		dump(DumpCSV)
 	}
 }
 
-func snapshotPids(pids []string) {
-	for _, pid := range pids {
-		pd, err := snapshotPid(pid)
-		if err == nil {
-			if !isKernelProc(pd) {
-				allpids[pid] = pd
-			}
-		} else {
-			if os.IsNotExist(err) {
-				delete(allpids, pid)
-			}
-		}
-	}
+//sampleResult carries one worker's outcome back to the collecting goroutine
+type sampleResult struct {
+	pid string
+	pd  *piddata
+	err error
 }
 
-func snapshotAll() []string {
-	os.Chdir("/proc")
-
-	f, err := os.Open("/proc")
-	if err != nil {
-		log.Fatal(err)
-	}
+//snapshotPids fans sampling of pids out across a bounded pool of workers,
+//each bounded by sampleTimeout, and returns a freshly built map of the
+//results. It never touches allpids directly, and deliberately runs
+//without mu held: sampling a whole host can take a while, and one slow
+//or wedged PID must not hold up every HTTP handler waiting on mu. The
+//caller swaps the returned map into allpids under mu.Lock once sampling
+//is done, so a snap built from the old map (and anything published from
+//it) is never mutated out from under a reader.
+func snapshotPids(pids []string) map[string]*piddata {
+	sem := make(chan struct{}, workers)
+	results := make(chan sampleResult, len(pids))
+	var wg sync.WaitGroup
 
-	entries, err := f.Readdir(0)
-	if err != nil {
-		log.Fatal(err)
+	for _, pid := range pids {
+		pid := pid
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), sampleTimeout)
+			defer cancel()
+			pd, err := source.Sample(ctx, pid)
+			results <- sampleResult{pid, pd, err}
+		}()
 	}
-
-	pids := []string{}
-	for _, e := range entries {
-		name := e.Name()
-		if name[0] >= '0' && name[0] <= '9' {
-			pids = append(pids, name)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	newpids := make(map[string]*piddata, len(pids))
+	for res := range results {
+		switch {
+		case res.err == nil:
+			if !isKernelProc(res.pd) {
+				newpids[res.pid] = res.pd
+			}
+		case res.err == context.DeadlineExceeded:
+			atomic.AddInt64(&timedOutSamples, 1)
+		default:
+			atomic.AddInt64(&droppedSamples, 1)
 		}
 	}
-
-	return pids
+	return newpids
 }
 
 //The main URL handler
@@ -212,15 +307,289 @@ func csvHandle(w http.ResponseWriter, r *http.Request) {
 	printCSV(w)
 }
 
+//Return the per-mapping smaps breakdown for a single PID
+func mapsHandle(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	pd, ok := allpids[r.URL.Query().Get("pid")]
+	mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	j, err := json.MarshalIndent(pd.Maps, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, string(j))
+}
+
+//memPoint is the subset of piddata tracked over time for a single PID
+type memPoint struct {
+	Name string `json:"name"`
+	RSS  int    `json:"rss"`
+	PSS  int    `json:"pss"`
+	USS  int    `json:"uss"`
+	Swap int    `json:"swap"`
+}
+
+//historyPoint is one sample of the time-series, scoped to the requested PIDs
+type historyPoint struct {
+	Seq  int                 `json:"seq"`
+	Time string              `json:"time"`
+	Pids map[string]memPoint `json:"pids"`
+}
+
+//Return the time-series of RSS/PSS/USS/swap for one PID, or all PIDs,
+//since the given sequence number
+func historyHandle(w http.ResponseWriter, r *http.Request) {
+	pid := r.URL.Query().Get("pid")
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+
+	mu.RLock()
+	points := make([]historyPoint, 0, len(history))
+	for _, s := range history {
+		if s.Seq <= since {
+			continue
+		}
+		hp := historyPoint{Seq: s.Seq, Time: s.Time, Pids: make(map[string]memPoint)}
+		for p, pd := range s.Pids {
+			if pid != "" && p != pid {
+				continue
+			}
+			hp.Pids[p] = memPoint{Name: pd.Name, RSS: pd.RSS, PSS: pd.PSS, USS: pd.USS, Swap: pd.Swap}
+		}
+		points = append(points, hp)
+	}
+	mu.RUnlock()
+
+	j, err := json.MarshalIndent(points, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, string(j))
+}
+
+//metricLabels formats the Prometheus label set common to every gauge for a PID
+func metricLabels(pid string, pd *piddata) string {
+	return fmt.Sprintf("pid=%q,name=%q,container_id=%q,cgroup=%q,unit=%q",
+		pid, pd.Name, pd.ContainerID, pd.Cgroup, pd.Unit)
+}
+
+//Return the current snapshot in Prometheus text exposition format
+func metricsHandle(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	fmt.Fprintln(w, "# HELP memchart_process_rss_kb Resident set size in kB")
+	fmt.Fprintln(w, "# TYPE memchart_process_rss_kb gauge")
+	for pid, pd := range allpids {
+		fmt.Fprintf(w, "memchart_process_rss_kb{%s} %d\n", metricLabels(pid, pd), pd.RSS)
+	}
+	fmt.Fprintln(w, "# HELP memchart_process_pss_kb Proportional set size in kB")
+	fmt.Fprintln(w, "# TYPE memchart_process_pss_kb gauge")
+	for pid, pd := range allpids {
+		fmt.Fprintf(w, "memchart_process_pss_kb{%s} %d\n", metricLabels(pid, pd), pd.PSS)
+	}
+	fmt.Fprintln(w, "# HELP memchart_process_uss_kb Unique set size in kB")
+	fmt.Fprintln(w, "# TYPE memchart_process_uss_kb gauge")
+	for pid, pd := range allpids {
+		fmt.Fprintf(w, "memchart_process_uss_kb{%s} %d\n", metricLabels(pid, pd), pd.USS)
+	}
+	fmt.Fprintln(w, "# HELP memchart_process_swap_kb Swapped out memory in kB")
+	fmt.Fprintln(w, "# TYPE memchart_process_swap_kb gauge")
+	for pid, pd := range allpids {
+		fmt.Fprintf(w, "memchart_process_swap_kb{%s} %d\n", metricLabels(pid, pd), pd.Swap)
+	}
+
+	fmt.Fprintln(w, "# HELP memchart_sample_dropped_total PIDs that could not be sampled (vanished or errored)")
+	fmt.Fprintln(w, "# TYPE memchart_sample_dropped_total counter")
+	fmt.Fprintf(w, "memchart_sample_dropped_total %d\n", atomic.LoadInt64(&droppedSamples))
+	fmt.Fprintln(w, "# HELP memchart_sample_timeout_total PIDs that exceeded the per-sample deadline")
+	fmt.Fprintln(w, "# TYPE memchart_sample_timeout_total counter")
+	fmt.Fprintf(w, "memchart_sample_timeout_total %d\n", atomic.LoadInt64(&timedOutSamples))
+}
+
+//Return the current group rollup (by container, systemd unit, cgroup or
+//PID namespace) as JSON
+func groupsHandle(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	groups := buildGroups(allpids)
+	mu.RUnlock()
+
+	j, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, string(j))
+}
+
+//Push one snapshot per sampling interval for the lifetime of the
+//connection, as newline-delimited JSON, or as Server-Sent Events when the
+//client asks for text/event-stream. Each snap read off ch is its own
+//map, built once by makeSnap and never touched again, so it is safe to
+//marshal here without mu: there is no live state left to race with.
+func streamHandle(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ch := subscribe()
+	defer unsubscribe(ch)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case s, ok := <-ch:
+			if !ok {
+				return
+			}
+			j, err := json.Marshal(s)
+			if err != nil {
+				continue
+			}
+			if sse {
+				fmt.Fprintf(w, "data: %s\n\n", j)
+			} else {
+				fmt.Fprintf(w, "%s\n", j)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+//Return only the PIDs whose RSS/PSS/USS changed since the given snapshot
+//sequence number, so a client can render a live chart without re-fetching
+//the full snapshot every interval. history lookup and makeSnap both run
+//under mu; base and current are each independently-owned, never-mutated
+//maps afterwards, so comparing them outside the lock is safe and, unlike
+//comparing two views of the same live map, can actually observe a change.
+func diffHandle(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+
+	mu.RLock()
+	var base *snap
+	for i := range history {
+		if history[i].Seq == since {
+			base = &history[i]
+			break
+		}
+	}
+	current := makeSnap()
+	mu.RUnlock()
+
+	changed := make(map[string]*piddata)
+	for pid, pd := range current.Pids {
+		var basePd *piddata
+		if base != nil {
+			basePd = base.Pids[pid]
+		}
+		if basePd == nil || basePd.RSS != pd.RSS || basePd.PSS != pd.PSS || basePd.USS != pd.USS {
+			changed[pid] = pd
+		}
+	}
+
+	out := struct {
+		Seq  int                 `json:"seq"`
+		Time string              `json:"time"`
+		Pids map[string]*piddata `json:"pids"`
+	}{current.Seq, current.Time, changed}
+
+	j, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, string(j))
+}
+
+//selfReport is memchart's own health, for operators running it as a
+//long-lived daemon
+type selfReport struct {
+	GoVersion         string           `json:"go_version"`
+	Goroutines        int              `json:"goroutines"`
+	SnapshotsRetained int              `json:"snapshots_retained"`
+	RSS               int              `json:"rss_kb"`
+	PSS               int              `json:"pss_kb"`
+	ConfiguredSeconds int              `json:"configured_interval_s"`
+	ObservedInterval  time.Duration    `json:"observed_interval_ns"`
+	MemStats          runtime.MemStats `json:"mem_stats"`
+}
+
+//Return memchart's own runtime.MemStats plus its RSS/PSS and sampling lag,
+//so a long-running instance can be checked for leaks without attaching pprof
+func selfHandle(w http.ResponseWriter, r *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	mu.RLock()
+	snapshots := len(history)
+	mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), sampleTimeout)
+	defer cancel()
+	self, err := source.Sample(ctx, strconv.Itoa(os.Getpid()))
+
+	report := selfReport{
+		GoVersion:         runtime.Version(),
+		Goroutines:        runtime.NumGoroutine(),
+		SnapshotsRetained: snapshots,
+		ConfiguredSeconds: seconds,
+		ObservedInterval:  time.Duration(atomic.LoadInt64(&lastIntervalNano)),
+		MemStats:          ms,
+	}
+	if err == nil {
+		report.RSS = self.RSS
+		report.PSS = self.PSS
+	}
+
+	j, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, string(j))
+}
+
 var verbose bool
 var port string
 var seconds int
 var exit bool
+var historySize int
+var sourceName string
+var source ProcessSource
+var workers int
+var sampleTimeout time.Duration
+
+//droppedSamples and timedOutSamples count PIDs skipped during sampling,
+//cumulatively for the life of the process; exposed via /metrics
+var droppedSamples int64
+var timedOutSamples int64
 
 //Serve the latest snapshot JSON data
 func webserver() {
 	http.HandleFunc("/", viewHandle)
 	http.HandleFunc("/csv", csvHandle)
+	http.HandleFunc("/maps", mapsHandle)
+	http.HandleFunc("/history", historyHandle)
+	http.HandleFunc("/metrics", metricsHandle)
+	http.HandleFunc("/groups", groupsHandle)
+	http.HandleFunc("/stream", streamHandle)
+	http.HandleFunc("/diff", diffHandle)
+	http.HandleFunc("/self", selfHandle)
 
 	log.Println("Listening at http://localhost:" + port)
 
@@ -235,7 +604,18 @@ func parseOptions() {
 	flag.IntVar(&seconds, "s", 120, "Seconds between measurements")
 	flag.BoolVar(&verbose, "v", false, "Verbose mode")
 	flag.BoolVar(&exit, "e", false, "Dump a single snapshot then exit immediately")
+	flag.IntVar(&historySize, "history", 60, "Number of past snapshots to retain for /history and /metrics")
+	flag.StringVar(&sourceName, "source", "", "Process source to sample from (default: best available for this platform)")
+	flag.IntVar(&workers, "j", 4, "Number of concurrent sampling workers")
+	flag.DurationVar(&sampleTimeout, "sample-timeout", 2*time.Second, "Deadline for sampling a single PID")
 	flag.Parse()
+
+	if workers < 1 {
+		log.Fatalf("-j must be at least 1, got %d", workers)
+	}
+	if historySize < 1 {
+		log.Fatalf("-history must be at least 1, got %d", historySize)
+	}
 }
 
 //Application entry point
@@ -243,6 +623,7 @@ func main() {
 	parseOptions()
 	log.SetFlags(0)
 	allpids = make(map[string]*piddata)
+	source = newProcessSource(sourceName)
 
 	if exit {
 		verbose = true
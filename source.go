@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+//ProcessSource abstracts over how process memory data is sampled, so the
+//rest of memchart does not need to know whether it is running on Linux or
+//being served by gopsutil on another platform
+type ProcessSource interface {
+	//List returns the ids of the processes currently visible to this source
+	List() ([]string, error)
+	//Sample reads the current memory data for a single process id. It
+	//should respect ctx's deadline so a single slow or stuck process
+	//cannot hold up a whole sampling cycle.
+	Sample(ctx context.Context, pid string) (*piddata, error)
+}
+
+//sourceFactories holds the ProcessSource implementations compiled into this
+//binary, keyed by name. Each source_*.go file registers itself from an
+//init(), gated by its own build tags.
+var sourceFactories = map[string]func() ProcessSource{}
+
+func registerSource(name string, factory func() ProcessSource) {
+	sourceFactories[name] = factory
+}
+
+//newProcessSource resolves the named source, falling back to the best one
+//compiled in for this platform when name is empty
+func newProcessSource(name string) ProcessSource {
+	if name != "" {
+		factory, ok := sourceFactories[name]
+		if !ok {
+			log.Fatalf("unknown process source %q", name)
+		}
+		return factory()
+	}
+
+	for _, preferred := range []string{"linux", "gopsutil"} {
+		if factory, ok := sourceFactories[preferred]; ok {
+			return factory()
+		}
+	}
+
+	log.Fatal("no process source available for this platform")
+	return nil
+}
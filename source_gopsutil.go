@@ -0,0 +1,74 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+func init() {
+	registerSource("gopsutil", func() ProcessSource { return gopsutilSource{} })
+}
+
+//gopsutilSource samples processes through gopsutil, giving memchart a
+//working backend on macOS, FreeBSD and Windows where there is no smaps to
+//read. gopsutil's MemoryInfoEx only carries real fields on Linux (it is an
+//empty struct everywhere else), so there is no platform-native way to get
+//genuine PSS/USS figures here; rather than mislabel RSS as them, this
+//source leaves PSS and USS at zero.
+type gopsutilSource struct{}
+
+func (gopsutilSource) List() ([]string, error) {
+	pids, err := process.Pids()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(pids))
+	for i, pid := range pids {
+		ids[i] = strconv.Itoa(int(pid))
+	}
+	return ids, nil
+}
+
+func (gopsutilSource) Sample(ctx context.Context, pid string) (*piddata, error) {
+	ipid, err := strconv.Atoi(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	proc, err := process.NewProcessWithContext(ctx, int32(ipid))
+	if err != nil {
+		return nil, err
+	}
+
+	// A failed read here is not the same as a genuinely empty cmdline:
+	// isKernelProc treats an empty cmdline as "this is a kernel thread",
+	// and gopsutil returns ErrNotImplementedError or a permission error
+	// for plenty of ordinary processes we just aren't allowed to inspect.
+	// Surface the read failure as a sampling error instead of silently
+	// mislabeling those processes as kernel threads and dropping them.
+	cmdline, err := proc.Cmdline()
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := proc.Name()
+	if err != nil {
+		name = ""
+	}
+
+	mi, err := proc.MemoryInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	pd := &piddata{cmdline: strings.TrimSpace(cmdline), Name: name}
+	pd.RSS = int(mi.RSS / 1024)
+
+	return pd, nil
+}
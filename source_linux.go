@@ -0,0 +1,243 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerSource("linux", func() ProcessSource { return linuxSource{} })
+}
+
+//linuxSource samples processes directly from /proc/$PID/smaps, giving exact
+//RSS/PSS/USS/swap figures down to the individual mapping
+type linuxSource struct{}
+
+func (linuxSource) List() ([]string, error) {
+	f, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if name[0] >= '0' && name[0] <= '9' {
+			pids = append(pids, name)
+		}
+	}
+
+	return pids, nil
+}
+
+//sampleReadResult carries the outcome of readPidData back across the
+//goroutine boundary in Sample
+type sampleReadResult struct {
+	pd  *piddata
+	err error
+}
+
+//Sample reads pid's memory data off a goroutine so a read that genuinely
+//blocks (a process stuck in D-state, a frozen cgroup, a stuck NFS-backed
+//root) can't hold up the caller past ctx's deadline. The read goroutine
+//itself is not killed when ctx expires - there's no way to interrupt a
+//blocking read(2) from here - but the caller is freed to move on to the
+//next pid instead of wedging the whole worker pool on one stuck file.
+func (linuxSource) Sample(ctx context.Context, pid string) (*piddata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan sampleReadResult, 1)
+	go func() {
+		pd, err := readPidData(pid)
+		done <- sampleReadResult{pd, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.pd, r.err
+	}
+}
+
+//readPidData does the actual blocking work of reading and parsing a
+//single process's /proc entries
+func readPidData(pid string) (*piddata, error) {
+	pidpath := "/proc/" + pid + "/"
+	cmdline, err := ioutil.ReadFile(pidpath + "cmdline")
+	if err != nil {
+		log.Println("No process with pid", pid)
+		return nil, err
+	}
+	smaps, err := ioutil.ReadFile(pidpath + "smaps")
+	if err != nil {
+		return nil, err
+	}
+	stat, err := ioutil.ReadFile(pidpath + "stat")
+	if err != nil {
+		return nil, err
+	}
+	i, j := strings.Index(string(stat), "("), strings.Index(string(stat), ")")
+	name := string(stat[i+1 : j])
+
+	pd := &piddata{cmdline: string(cmdline), Name: name}
+	pd.Maps = getsmaps(string(smaps))
+	pd.RSS, pd.PSS, pd.USS, pd.Swap = memsizes(pd.Maps)
+	pd.Cgroup, pd.Unit, pd.ContainerID = cgroupInfo(pidpath)
+	pd.PIDNS = pidNamespace(pidpath)
+
+	return pd, nil
+}
+
+//cgroupInfo reads /proc/$PID/cgroup and extracts the cgroup v2 path, the
+//owning systemd unit (if any) and the Docker/containerd container ID (if any)
+func cgroupInfo(pidpath string) (cgroup, unit, containerID string) {
+	data, err := ioutil.ReadFile(pidpath + "cgroup")
+	if err != nil {
+		return "", "", ""
+	}
+
+	cgroup = cgroupPath(string(data))
+	unit = cgroupUnit(cgroup)
+	containerID = cgroupContainerID(cgroup)
+	return cgroup, unit, containerID
+}
+
+//cgroupPath extracts the cgroup v2 unified path (hierarchy-id 0), falling
+//back to the first line for cgroup v1 hosts
+func cgroupPath(data string) string {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	for _, line := range lines {
+		f := strings.SplitN(line, ":", 3)
+		if len(f) == 3 && f[0] == "0" {
+			return f[2]
+		}
+	}
+	if len(lines) > 0 {
+		if f := strings.SplitN(lines[0], ":", 3); len(f) == 3 {
+			return f[2]
+		}
+	}
+	return ""
+}
+
+//cgroupUnit returns the systemd unit owning the cgroup path, if any
+func cgroupUnit(path string) string {
+	base := path[strings.LastIndex(path, "/")+1:]
+	for _, suffix := range []string{".service", ".scope", ".slice"} {
+		if strings.HasSuffix(base, suffix) {
+			return base
+		}
+	}
+	return ""
+}
+
+//containerIDPattern matches the 64 hex character container ID that Docker
+//and containerd embed in the cgroup path, e.g.
+///system.slice/docker-<id>.scope or /kubepods/.../cri-containerd-<id>.scope
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+//cgroupContainerID extracts the Docker/containerd container ID from a
+//cgroup path, if present
+func cgroupContainerID(path string) string {
+	return containerIDPattern.FindString(path)
+}
+
+//pidNamespace returns the inode identifying the PID namespace a process
+//lives in, e.g. "pid:[4026531836]"
+func pidNamespace(pidpath string) string {
+	ns, err := os.Readlink(pidpath + "ns/pid")
+	if err != nil {
+		return ""
+	}
+	return ns
+}
+
+// getsmaps parses the individual map entries from a smaps-formatted string
+func getsmaps(smaps string) []mapping {
+	var maps []mapping
+	var cur *mapping
+
+	lines := strings.Split(smaps, "\n")
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "VmFlags:") {
+			continue
+		}
+		f := strings.Fields(line)
+		if "kB" != (f[len(f)-1]) {
+			if cur != nil {
+				maps = append(maps, *cur)
+			}
+			cur = &mapping{Perms: f[1]}
+			if len(f) > 5 {
+				cur.Path = f[5]
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		n := strings.ToLower(strings.TrimRight(f[0], ":"))
+		v, _ := strconv.Atoi(f[1])
+		switch n {
+		case "size":
+			cur.Size = v
+		case "rss":
+			cur.RSS = v
+		case "pss":
+			cur.PSS = v
+		case "shared_clean":
+			cur.SharedClean = v
+		case "shared_dirty":
+			cur.SharedDirty = v
+		case "private_clean":
+			cur.PrivateClean = v
+		case "private_dirty":
+			cur.PrivateDirty = v
+		case "swap":
+			cur.Swap = v
+		case "swappss":
+			cur.SwapPSS = v
+		case "anonymous":
+			cur.Anonymous = v
+		case "referenced":
+			cur.Referenced = v
+		case "locked":
+			cur.Locked = v
+		}
+	}
+	if cur != nil {
+		maps = append(maps, *cur)
+	}
+
+	return maps
+}
+
+//memsizes aggregates the per-mapping RSS/PSS/USS/swap totals for a PID
+func memsizes(maps []mapping) (rss, pss, uss, swap int) {
+	for _, m := range maps {
+		rss += m.RSS
+		pss += m.PSS
+		uss += m.PrivateClean + m.PrivateDirty
+		swap += m.Swap
+	}
+	return rss, pss, uss, swap
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package main
+
+import "testing"
+
+func TestGetsmapsSkipsVmFlags(t *testing.T) {
+	const smaps = `00400000-00452000 r-xp 00000000 08:02 173521                             /bin/cat
+Size:                204 kB
+Rss:                 180 kB
+Pss:                 178 kB
+Shared_Clean:          0 kB
+Shared_Dirty:          0 kB
+Private_Clean:       180 kB
+Private_Dirty:         0 kB
+Referenced:          180 kB
+Anonymous:             0 kB
+Swap:                  0 kB
+SwapPss:               0 kB
+Locked:                0 kB
+VmFlags: rd ex mr mw me dw
+00651000-00652000 rw-p 00050000 08:02 173521                             /bin/cat
+Size:                  4 kB
+Rss:                   4 kB
+Pss:                   4 kB
+Shared_Clean:          0 kB
+Shared_Dirty:          0 kB
+Private_Clean:         0 kB
+Private_Dirty:         4 kB
+Referenced:            4 kB
+Anonymous:             4 kB
+Swap:                  0 kB
+SwapPss:               0 kB
+Locked:                0 kB
+VmFlags: rd wr mr mw me ac
+`
+
+	maps := getsmaps(smaps)
+	if len(maps) != 2 {
+		t.Fatalf("got %d mappings, want 2 (VmFlags trailer must not be read as a header): %+v", len(maps), maps)
+	}
+
+	if maps[0].Path != "/bin/cat" || maps[0].RSS != 180 || maps[0].PSS != 178 {
+		t.Errorf("mapping 0 = %+v, want Path=/bin/cat RSS=180 PSS=178", maps[0])
+	}
+	if maps[1].Path != "/bin/cat" || maps[1].RSS != 4 || maps[1].PrivateDirty != 4 {
+		t.Errorf("mapping 1 = %+v, want Path=/bin/cat RSS=4 PrivateDirty=4", maps[1])
+	}
+}
+
+func TestCgroupPath(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "v2 unified",
+			data: "0::/system.slice/docker-deadbeefcafe.scope\n",
+			want: "/system.slice/docker-deadbeefcafe.scope",
+		},
+		{
+			name: "v1 falls back to first line",
+			data: "12:pids:/user.slice\n11:memory:/user.slice\n",
+			want: "/user.slice",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := cgroupPath(c.data); got != c.want {
+				t.Errorf("cgroupPath(%q) = %q, want %q", c.data, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCgroupUnit(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/system.slice/docker-deadbeefcafe.scope", "docker-deadbeefcafe.scope"},
+		{"/system.slice/sshd.service", "sshd.service"},
+		{"/user.slice", "user.slice"},
+		{"/", ""},
+	}
+
+	for _, c := range cases {
+		if got := cgroupUnit(c.path); got != c.want {
+			t.Errorf("cgroupUnit(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
+
+func TestCgroupContainerID(t *testing.T) {
+	const id = "4283fefc63f0cd0e873a0000c6d07ef7b77e90d3593ad699fc1f7cd5bb2e35cb"
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/system.slice/docker-" + id + ".scope", id},
+		{"/kubepods/burstable/pod123/cri-containerd-" + id + ".scope", id},
+		{"/user.slice", ""},
+	}
+
+	for _, c := range cases {
+		if got := cgroupContainerID(c.path); got != c.want {
+			t.Errorf("cgroupContainerID(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}